@@ -6,13 +6,216 @@ import (
 	"k8s.io/client-go/pkg/api/resource"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/apps/v1beta1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	"k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	policyv1beta1 "k8s.io/client-go/pkg/apis/policy/v1beta1"
 	"k8s.io/client-go/pkg/util/intstr"
 
+	monitoringv1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+
 	"github.bus.zalan.do/acid/postgres-operator/pkg/spec"
 	"github.bus.zalan.do/acid/postgres-operator/pkg/util"
 	"github.bus.zalan.do/acid/postgres-operator/pkg/util/constants"
 )
 
+const (
+	metricsQueriesMountPath    = "/etc/postgres-exporter"
+	backupCredentialsMountPath = "/etc/backup-credentials"
+)
+
+// genSpiloConfiguration renders the SPILO_CONFIGURATION env var. When backup.RestoreFrom is
+// set, Spilo bootstraps by restoring the named WAL-E/WAL-G base backup instead of running
+// initdb.
+func (c *Cluster) genSpiloConfiguration(pgVersion string, backup spec.Backup) string {
+	walLevelParameter := ""
+	if len(c.Spec.Publications) > 0 {
+		walLevelParameter = `
+  parameters:
+    wal_level: logical`
+	}
+
+	if backup.RestoreFrom != "" {
+		return fmt.Sprintf(`
+postgresql:
+  bin_dir: /usr/lib/postgresql/%s/bin%s
+bootstrap:
+  method: restore_or_initdb
+  restore_or_initdb:
+    command: /scripts/restore_from_backup.sh --backup-name %s --target %s --bucket %s
+  users:
+    %s:
+      password: NULL
+      options:
+        - createdb
+        - nologin
+  pg_hba:
+  - hostnossl all all all reject
+  - hostssl   all +%s all pam
+  - hostssl   all all all md5`, pgVersion, walLevelParameter, backup.RestoreFrom, backup.Target, backup.Bucket, c.OpConfig.PamRoleName, c.OpConfig.PamRoleName)
+	}
+
+	return fmt.Sprintf(`
+postgresql:
+  bin_dir: /usr/lib/postgresql/%s/bin%s
+bootstrap:
+  initdb:
+  - auth-host: md5
+  - auth-local: trust
+  users:
+    %s:
+      password: NULL
+      options:
+        - createdb
+        - nologin
+  pg_hba:
+  - hostnossl all all all reject
+  - hostssl   all +%s all pam
+  - hostssl   all all all md5`, pgVersion, walLevelParameter, c.OpConfig.PamRoleName, c.OpConfig.PamRoleName)
+}
+
+// genBackupEnvVars builds the WAL-E/WAL-G env vars for the configured object store target.
+func (c *Cluster) genBackupEnvVars(backup spec.Backup) []v1.EnvVar {
+	envVars := []v1.EnvVar{
+		{
+			Name:  "BACKUP_SCHEDULE",
+			Value: backup.Schedule,
+		},
+		{
+			Name:  "BACKUP_NUM_TO_RETAIN",
+			Value: backup.Retention,
+		},
+	}
+
+	credentialsRef := func(key string) *v1.EnvVarSource {
+		return &v1.EnvVarSource{
+			SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{
+					Name: backup.CredentialsSecretName,
+				},
+				Key: key,
+			},
+		}
+	}
+
+	switch backup.Target {
+	case "s3":
+		envVars = append(envVars,
+			v1.EnvVar{Name: "WALE_S3_PREFIX", Value: fmt.Sprintf("s3://%s/%s", backup.Bucket, c.Metadata.Name)},
+			v1.EnvVar{Name: "WAL_S3_BUCKET", Value: backup.Bucket},
+			v1.EnvVar{Name: "AWS_ACCESS_KEY_ID", ValueFrom: credentialsRef("aws-access-key-id")},
+			v1.EnvVar{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: credentialsRef("aws-secret-access-key")},
+		)
+	case "gcs":
+		envVars = append(envVars,
+			v1.EnvVar{Name: "WALE_GS_PREFIX", Value: fmt.Sprintf("gs://%s/%s", backup.Bucket, c.Metadata.Name)},
+			v1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: backupCredentialsMountPath + "/credentials.json"},
+		)
+	case "azure":
+		envVars = append(envVars,
+			v1.EnvVar{Name: "WALG_AZ_PREFIX", Value: fmt.Sprintf("azure://%s/%s", backup.Bucket, c.Metadata.Name)},
+			v1.EnvVar{Name: "AZURE_STORAGE_ACCOUNT", ValueFrom: credentialsRef("azure-storage-account")},
+			v1.EnvVar{Name: "AZURE_STORAGE_ACCESS_KEY", ValueFrom: credentialsRef("azure-storage-access-key")},
+		)
+	}
+
+	if backup.EncryptionKeySecretName != "" {
+		envVars = append(envVars, v1.EnvVar{
+			Name: "WALE_ENCRYPT_KEY_ID",
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: backup.EncryptionKeySecretName,
+					},
+					Key: "encryption-key",
+				},
+			},
+		})
+	}
+
+	return envVars
+}
+
+// metricsEnabled reports whether the postgres_exporter sidecar should be added to the pod,
+// honoring a per-cluster override of the operator-wide default.
+func (c *Cluster) metricsEnabled() bool {
+	if c.Spec.EnableMetrics != nil {
+		return *c.Spec.EnableMetrics
+	}
+
+	return c.OpConfig.EnableMetrics
+}
+
+// genMetricsExporterContainer builds the postgres_exporter sidecar that lets Prometheus
+// scrape per-database metrics; a user-supplied queries.yaml is mounted from the metrics
+// ConfigMap generated by genMetricsConfigMap to cover custom SQL metrics.
+func (c *Cluster) genMetricsExporterContainer() v1.Container {
+	return v1.Container{
+		Name:  "postgres-exporter",
+		Image: c.OpConfig.MetricsExporterImage,
+		Ports: []v1.ContainerPort{
+			{
+				ContainerPort: 9187,
+				Protocol:      v1.ProtocolTCP,
+			},
+		},
+		Env: []v1.EnvVar{
+			{
+				Name:  "DATA_SOURCE_NAME",
+				Value: "host=127.0.0.1 port=5432 user=postgres sslmode=disable",
+			},
+			{
+				Name:  "PG_EXPORTER_EXTEND_QUERY_PATH",
+				Value: "/etc/postgres-exporter/queries.yaml",
+			},
+		},
+		VolumeMounts: []v1.VolumeMount{
+			{
+				Name:      "metrics-queries",
+				MountPath: metricsQueriesMountPath,
+			},
+		},
+	}
+}
+
+// genMetricsConfigMap ships the user-supplied custom SQL metrics definitions to the
+// postgres_exporter sidecar via a mounted ConfigMap.
+func (c *Cluster) genMetricsConfigMap(queriesYaml string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-metrics-queries", c.Metadata.Name),
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.labelsSet(),
+		},
+		Data: map[string]string{
+			"queries.yaml": queriesYaml,
+		},
+	}
+}
+
+// genServiceMonitor builds the ServiceMonitor that tells the Prometheus Operator to scrape
+// this cluster's postgres_exporter port on every managed pod.
+func (c *Cluster) genServiceMonitor() *monitoringv1.ServiceMonitor {
+	return &monitoringv1.ServiceMonitor{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      c.Metadata.Name,
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.labelsSet(),
+		},
+		Spec: monitoringv1.ServiceMonitorSpec{
+			Selector: v1.LabelSelector{
+				MatchLabels: c.labelsSet(),
+			},
+			Endpoints: []monitoringv1.Endpoint{
+				{
+					Port:     "metrics",
+					Interval: "30s",
+				},
+			},
+		},
+	}
+}
+
 func resourceList(resources spec.Resources) *v1.ResourceList {
 	resourceList := v1.ResourceList{}
 	if resources.Cpu != "" {
@@ -26,7 +229,7 @@ func resourceList(resources spec.Resources) *v1.ResourceList {
 	return &resourceList
 }
 
-func (c *Cluster) genPodTemplate(resourceList *v1.ResourceList, pgVersion string) *v1.PodTemplateSpec {
+func (c *Cluster) genPodTemplate(resourceList *v1.ResourceList, pgVersion string, scheduling spec.Scheduling, backup spec.Backup) *v1.PodTemplateSpec {
 	envVars := []v1.EnvVar{
 		{
 			Name:  "SCOPE",
@@ -85,27 +288,15 @@ func (c *Cluster) genPodTemplate(resourceList *v1.ResourceList, pgVersion string
 			Value: c.OpConfig.PamConfiguration,
 		},
 		{
-			Name: "SPILO_CONFIGURATION",
-			Value: fmt.Sprintf(`
-postgresql:
-  bin_dir: /usr/lib/postgresql/%s/bin
-bootstrap:
-  initdb:
-  - auth-host: md5
-  - auth-local: trust
-  users:
-    %s:
-      password: NULL
-      options:
-        - createdb
-        - nologin
-  pg_hba:
-  - hostnossl all all all reject
-  - hostssl   all +%s all pam
-  - hostssl   all all all md5`, pgVersion, c.OpConfig.PamRoleName, c.OpConfig.PamRoleName),
+			Name:  "SPILO_CONFIGURATION",
+			Value: c.genSpiloConfiguration(pgVersion, backup),
 		},
 	}
 
+	if backup.Target != "" {
+		envVars = append(envVars, c.genBackupEnvVars(backup)...)
+	}
+
 	container := v1.Container{
 		Name:            c.Metadata.Name,
 		Image:           c.OpConfig.DockerImage,
@@ -135,12 +326,49 @@ bootstrap:
 		},
 		Env: envVars,
 	}
+
+	volumes := []v1.Volume{}
+
+	if backup.Target == "gcs" {
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+			Name:      "backup-credentials",
+			MountPath: backupCredentialsMountPath,
+		})
+		volumes = append(volumes, v1.Volume{
+			Name: "backup-credentials",
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: backup.CredentialsSecretName,
+				},
+			},
+		})
+	}
+
+	containers := []v1.Container{container}
+	if c.metricsEnabled() {
+		containers = append(containers, c.genMetricsExporterContainer())
+		volumes = append(volumes, v1.Volume{
+			Name: "metrics-queries",
+			VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: fmt.Sprintf("%s-metrics-queries", c.Metadata.Name),
+					},
+				},
+			},
+		})
+	}
+
 	terminateGracePeriodSeconds := int64(30)
 
 	podSpec := v1.PodSpec{
 		ServiceAccountName:            c.OpConfig.ServiceAccountName,
 		TerminationGracePeriodSeconds: &terminateGracePeriodSeconds,
-		Containers:                    []v1.Container{container},
+		Containers:                    containers,
+		Volumes:                       volumes,
+		NodeSelector:                  scheduling.NodeSelector,
+		Tolerations:                   scheduling.Tolerations,
+		Affinity:                      c.podAntiAffinity(scheduling),
 	}
 
 	template := v1.PodTemplateSpec{
@@ -154,9 +382,35 @@ bootstrap:
 	return &template
 }
 
+// podAntiAffinity builds a pod anti-affinity rule that keeps pods belonging to the
+// same Postgres cluster apart across the given topology domain (e.g. node or zone),
+// so that a single node/zone failure cannot take out the primary and all replicas.
+func (c *Cluster) podAntiAffinity(scheduling spec.Scheduling) *v1.Affinity {
+	topologyKey := scheduling.AntiAffinityTopologyKey
+	if topologyKey == "" {
+		topologyKey = c.OpConfig.PodAntiAffinityTopologyKey
+	}
+	if topologyKey == "" {
+		return nil
+	}
+
+	return &v1.Affinity{
+		PodAntiAffinity: &v1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{
+				{
+					LabelSelector: &v1.LabelSelector{
+						MatchLabels: c.labelsSet(),
+					},
+					TopologyKey: topologyKey,
+				},
+			},
+		},
+	}
+}
+
 func (c *Cluster) genStatefulSet(spec spec.PostgresSpec) *v1beta1.StatefulSet {
 	resourceList := resourceList(spec.Resources)
-	podTemplate := c.genPodTemplate(resourceList, spec.PgVersion)
+	podTemplate := c.genPodTemplate(resourceList, spec.PgVersion, spec.Scheduling, spec.Backup)
 	volumeClaimTemplate := persistentVolumeClaimTemplate(spec.Volume.Size, spec.Volume.StorageClass)
 
 	statefulSet := &v1beta1.StatefulSet{
@@ -176,6 +430,49 @@ func (c *Cluster) genStatefulSet(spec spec.PostgresSpec) *v1beta1.StatefulSet {
 	return statefulSet
 }
 
+// genBackupCronJob builds the CronJob that triggers a WAL-E/WAL-G base backup on the
+// schedule configured in spec.Backup.
+func (c *Cluster) genBackupCronJob(backup spec.Backup) *v2alpha1.CronJob {
+	podTemplate := v1.PodTemplateSpec{
+		ObjectMeta: v1.ObjectMeta{
+			Labels: c.labelsSet(),
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:  "backup",
+					Image: c.OpConfig.DockerImage,
+					Command: []string{
+						"/scripts/trigger_basebackup.sh",
+						c.Metadata.Name,
+					},
+					Env: c.genBackupEnvVars(backup),
+				},
+			},
+		},
+	}
+
+	cronJob := &v2alpha1.CronJob{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-backup", c.Metadata.Name),
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.labelsSet(),
+		},
+		Spec: v2alpha1.CronJobSpec{
+			Schedule:          backup.Schedule,
+			ConcurrencyPolicy: v2alpha1.ForbidConcurrent,
+			JobTemplate: v2alpha1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: podTemplate,
+				},
+			},
+		},
+	}
+
+	return cronJob
+}
+
 func persistentVolumeClaimTemplate(volumeSize, volumeStorageClass string) *v1.PersistentVolumeClaim {
 	metadata := v1.ObjectMeta{
 		Name: constants.DataVolumeName,
@@ -239,7 +536,7 @@ func (c *Cluster) genService(allowedSourceRanges []string) *v1.Service {
 		},
 		Spec: v1.ServiceSpec{
 			Type:  v1.ServiceTypeLoadBalancer,
-			Ports: []v1.ServicePort{{Port: 5432, TargetPort: intstr.IntOrString{IntVal: 5432}}},
+			Ports: c.servicePorts(),
 			LoadBalancerSourceRanges: allowedSourceRanges,
 		},
 	}
@@ -247,6 +544,168 @@ func (c *Cluster) genService(allowedSourceRanges []string) *v1.Service {
 	return service
 }
 
+// servicePorts lists the ports the primary Service should publish: 5432 for Postgres, plus
+// 9187 for the postgres_exporter sidecar when metrics are enabled.
+func (c *Cluster) servicePorts() []v1.ServicePort {
+	ports := []v1.ServicePort{
+		{Port: 5432, TargetPort: intstr.IntOrString{IntVal: 5432}},
+	}
+
+	if c.metricsEnabled() {
+		ports = append(ports, v1.ServicePort{Name: "metrics", Port: 9187, TargetPort: intstr.IntOrString{IntVal: 9187}})
+	}
+
+	return ports
+}
+
+func (c *Cluster) connectionPoolerName() string {
+	return fmt.Sprintf("%s-pooler", c.Metadata.Name)
+}
+
+// connectionPoolerLabelsSet extends the cluster's own label set with an "application:
+// pgbouncer" marker so PgBouncer's pods don't alias the Postgres StatefulSet pods.
+func (c *Cluster) connectionPoolerLabelsSet() map[string]string {
+	labels := make(map[string]string, len(c.labelsSet())+1)
+	for k, v := range c.labelsSet() {
+		labels[k] = v
+	}
+	labels["application"] = "pgbouncer"
+
+	return labels
+}
+
+// genPgBouncerDeployment builds the Deployment running the PgBouncer connection pooler in
+// front of the cluster's primary.
+func (c *Cluster) genPgBouncerDeployment(pooler spec.ConnectionPooler) *extensionsv1beta1.Deployment {
+	poolerName := c.connectionPoolerName()
+
+	envVars := []v1.EnvVar{
+		{
+			Name:  "PGHOST",
+			Value: c.Metadata.Name,
+		},
+		{
+			Name:  "PGPORT",
+			Value: "5432",
+		},
+		{
+			Name:  "POOL_MODE",
+			Value: pooler.PoolMode,
+		},
+		{
+			Name:  "MAX_CLIENT_CONN",
+			Value: pooler.MaxClientConnections,
+		},
+		{
+			Name:  "DEFAULT_POOL_SIZE",
+			Value: pooler.DefaultPoolSize,
+		},
+		{
+			Name:  "AUTH_QUERY",
+			Value: pooler.AuthQuery,
+		},
+		{
+			Name: "AUTH_USER_PASSWORD",
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{
+						Name: c.credentialSecretName(pooler.AuthUsername),
+					},
+					Key: "password",
+				},
+			},
+		},
+	}
+
+	container := v1.Container{
+		Name:  poolerName,
+		Image: c.OpConfig.ConnectionPoolerImage,
+		Ports: []v1.ContainerPort{
+			{
+				ContainerPort: 6432,
+				Protocol:      v1.ProtocolTCP,
+			},
+		},
+		Env: envVars,
+	}
+
+	numberOfInstances := pooler.NumberOfInstances
+
+	deployment := &extensionsv1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      poolerName,
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.connectionPoolerLabelsSet(),
+		},
+		Spec: extensionsv1beta1.DeploymentSpec{
+			Replicas: &numberOfInstances,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels: c.connectionPoolerLabelsSet(),
+				},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{container},
+				},
+			},
+		},
+	}
+
+	return deployment
+}
+
+// genPgBouncerService builds the dedicated Service exposing the pooler's port 6432, separate
+// from the primary's Service generated by genService.
+func (c *Cluster) genPgBouncerService() *v1.Service {
+	service := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      c.connectionPoolerName(),
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.connectionPoolerLabelsSet(),
+		},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeClusterIP,
+			Selector: c.connectionPoolerLabelsSet(),
+			Ports:    []v1.ServicePort{{Port: 6432, TargetPort: intstr.IntOrString{IntVal: 6432}}},
+		},
+	}
+
+	return service
+}
+
+// genPodDisruptionBudget builds a PodDisruptionBudget selecting the cluster's pods, with
+// minAvailable derived from the number of instances so that a voluntary disruption (e.g.
+// `kubectl drain` during a node upgrade) cannot evict the primary and all replicas at once.
+// The offset subtracted from numberOfInstances defaults to 1 (keep N-1 available) but can be
+// overridden cluster-wide via OpConfig, the same way PodAntiAffinityTopologyKey provides an
+// operator-level default for scheduling.
+func (c *Cluster) genPodDisruptionBudget(numberOfInstances int32) *policyv1beta1.PodDisruptionBudget {
+	minAvailableOffset := c.OpConfig.PodDisruptionBudgetMinAvailableOffset
+	if minAvailableOffset == 0 {
+		minAvailableOffset = 1
+	}
+
+	minAvailableCount := numberOfInstances - minAvailableOffset
+	if minAvailableCount < 0 {
+		minAvailableCount = 0
+	}
+
+	minAvailable := intstr.FromInt(int(minAvailableCount))
+
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-pdb", c.Metadata.Name),
+			Namespace: c.Metadata.Namespace,
+			Labels:    c.labelsSet(),
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector: &v1.LabelSelector{
+				MatchLabels: c.labelsSet(),
+			},
+		},
+	}
+}
+
 func (c *Cluster) genEndpoints() *v1.Endpoints {
 	endpoints := &v1.Endpoints{
 		ObjectMeta: v1.ObjectMeta{
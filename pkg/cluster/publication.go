@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.bus.zalan.do/acid/postgres-operator/pkg/spec"
+)
+
+// syncPublications reconciles the logical replication publications declared under
+// spec.Databases/spec.Publications against the running cluster: publications that are
+// missing get created and existing ones get their table list set to the manifest's.
+// Publications that were removed from the manifest are not dropped here. It also checks
+// replication lag of each publication's subscribers and emits a warning event on this
+// cluster once the configured threshold is exceeded.
+func (c *Cluster) syncPublications() error {
+	for dbname, publications := range c.Spec.Publications {
+		for name, publication := range publications {
+			if err := c.syncPublication(dbname, name, publication); err != nil {
+				return fmt.Errorf("could not sync publication %q in database %q: %v", name, dbname, err)
+			}
+
+			if err := c.checkPublicationLag(dbname, name, publication); err != nil {
+				return fmt.Errorf("could not check replication lag for publication %q in database %q: %v", name, dbname, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncSubscriptions reconciles the logical replication subscriptions declared under
+// spec.Databases/spec.Subscriptions, pointing each one at the source publication named in
+// the manifest.
+func (c *Cluster) syncSubscriptions() error {
+	for dbname, subscriptions := range c.Spec.Subscriptions {
+		for name, subscription := range subscriptions {
+			if err := c.syncSubscription(dbname, name, subscription); err != nil {
+				return fmt.Errorf("could not sync subscription %q in database %q: %v", name, dbname, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Cluster) syncPublication(dbname, name string, publication spec.PublicationSpec) error {
+	db, err := c.databaseConnection(dbname)
+	if err != nil {
+		return fmt.Errorf("could not connect to database %q: %v", dbname, err)
+	}
+
+	exists, err := publicationExists(db, name)
+	if err != nil {
+		return err
+	}
+
+	tables := quotedTableList(publication.Tables)
+	quotedName := pq.QuoteIdentifier(name)
+
+	if !exists {
+		query := fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", quotedName, tables)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("could not create publication: %v", err)
+		}
+		return nil
+	}
+
+	query := fmt.Sprintf("ALTER PUBLICATION %s SET TABLE %s", quotedName, tables)
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("could not alter publication: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) syncSubscription(dbname, name string, subscription spec.SubscriptionSpec) error {
+	db, err := c.databaseConnection(dbname)
+	if err != nil {
+		return fmt.Errorf("could not connect to database %q: %v", dbname, err)
+	}
+
+	exists, err := subscriptionExists(db, name)
+	if err != nil {
+		return err
+	}
+
+	quotedName := pq.QuoteIdentifier(name)
+	quotedPublication := pq.QuoteIdentifier(subscription.PublicationName)
+
+	if !exists {
+		query := fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s",
+			quotedName, pq.QuoteLiteral(subscription.ConnInfo), quotedPublication)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("could not create subscription: %v", err)
+		}
+		return nil
+	}
+
+	query := fmt.Sprintf("ALTER SUBSCRIPTION %s SET PUBLICATION %s", quotedName, quotedPublication)
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("could not alter subscription: %v", err)
+	}
+
+	return nil
+}
+
+// deletePublication drops a publication and its backing replication slot as part of cluster
+// teardown, so that a deleted cluster does not leave a dangling slot on the source.
+func (c *Cluster) deletePublication(dbname, name string) error {
+	db, err := c.databaseConnection(dbname)
+	if err != nil {
+		return fmt.Errorf("could not connect to database %q: %v", dbname, err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP PUBLICATION IF EXISTS %s", pq.QuoteIdentifier(name))); err != nil {
+		return fmt.Errorf("could not drop publication %q: %v", name, err)
+	}
+
+	if _, err := db.Exec("SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1", name); err != nil {
+		return fmt.Errorf("could not drop replication slot for publication %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// deleteSubscription drops a subscription as part of cluster teardown.
+func (c *Cluster) deleteSubscription(dbname, name string) error {
+	db, err := c.databaseConnection(dbname)
+	if err != nil {
+		return fmt.Errorf("could not connect to database %q: %v", dbname, err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP SUBSCRIPTION IF EXISTS %s", pq.QuoteIdentifier(name))); err != nil {
+		return fmt.Errorf("could not drop subscription %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// checkPublicationLag inspects pg_stat_replication for the publication's known subscribers
+// and emits a warning event once the worst replay lag among them exceeds
+// publication.LagWarningSeconds. application_name in pg_stat_replication is the connecting
+// subscriber's application_name (which defaults to its subscription name), not the
+// publication name, so the lookup is keyed off publication.Subscribers rather than name.
+func (c *Cluster) checkPublicationLag(dbname, name string, publication spec.PublicationSpec) error {
+	if publication.LagWarningSeconds == 0 || len(publication.Subscribers) == 0 {
+		return nil
+	}
+
+	db, err := c.databaseConnection(dbname)
+	if err != nil {
+		return fmt.Errorf("could not connect to database %q: %v", dbname, err)
+	}
+
+	var lagSeconds float64
+	row := db.QueryRow(
+		"SELECT COALESCE(MAX(EXTRACT(EPOCH FROM replay_lag)), 0) FROM pg_stat_replication WHERE application_name = ANY($1)",
+		pq.Array(publication.Subscribers),
+	)
+	if err := row.Scan(&lagSeconds); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	if lagSeconds > float64(publication.LagWarningSeconds) {
+		c.eventRecorder.Eventf(c.GetReference(), v1.EventTypeWarning, "ReplicationLag",
+			"publication %q in database %q is lagging by %.0fs (threshold %ds)", name, dbname, lagSeconds, publication.LagWarningSeconds)
+	}
+
+	return nil
+}
+
+// deleteLogicalReplication drops every publication and subscription declared in the spec, as
+// part of cluster teardown.
+func (c *Cluster) deleteLogicalReplication() error {
+	for dbname, publications := range c.Spec.Publications {
+		for name := range publications {
+			if err := c.deletePublication(dbname, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dbname, subscriptions := range c.Spec.Subscriptions {
+		for name := range subscriptions {
+			if err := c.deleteSubscription(dbname, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func quotedTableList(tables []string) string {
+	quoted := make([]string, 0, len(tables))
+	for _, table := range tables {
+		quoted = append(quoted, pq.QuoteIdentifier(table))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+func publicationExists(db *sql.DB, name string) (bool, error) {
+	var exists bool
+	row := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", name)
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func subscriptionExists(db *sql.DB, name string) (bool, error) {
+	var exists bool
+	row := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_subscription WHERE subname = $1)", name)
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
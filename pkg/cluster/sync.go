@@ -0,0 +1,265 @@
+package cluster
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/pkg/api/errors"
+
+	"github.bus.zalan.do/acid/postgres-operator/pkg/spec"
+)
+
+// Sync reconciles the StatefulSet and the cluster's auxiliary resources against newSpec:
+// the rolling update/switchover strategy, scheduled backups, the PodDisruptionBudget, the
+// connection pooler, logical replication and metrics.
+func (c *Cluster) Sync(oldSpec, newSpec spec.PostgresSpec) error {
+	if err := c.syncMetrics(newSpec); err != nil {
+		return fmt.Errorf("could not sync metrics: %v", err)
+	}
+
+	if err := c.syncStatefulSet(newSpec); err != nil {
+		return fmt.Errorf("could not sync statefulset: %v", err)
+	}
+
+	if err := c.syncBackup(newSpec.Backup); err != nil {
+		return fmt.Errorf("could not sync backup: %v", err)
+	}
+
+	if err := c.syncPodDisruptionBudget(newSpec.NumberOfInstances); err != nil {
+		return fmt.Errorf("could not sync pod disruption budget: %v", err)
+	}
+
+	if err := c.syncConnectionPooler(newSpec); err != nil {
+		return fmt.Errorf("could not sync connection pooler: %v", err)
+	}
+
+	if err := c.syncPublications(); err != nil {
+		return fmt.Errorf("could not sync publications: %v", err)
+	}
+
+	if err := c.syncSubscriptions(); err != nil {
+		return fmt.Errorf("could not sync subscriptions: %v", err)
+	}
+
+	return nil
+}
+
+// Delete tears down the auxiliary resources Sync created, as part of cluster teardown.
+func (c *Cluster) Delete() error {
+	if err := c.deleteBackupCronJob(); err != nil {
+		return fmt.Errorf("could not delete backup cronjob: %v", err)
+	}
+
+	if err := c.deletePodDisruptionBudget(); err != nil {
+		return fmt.Errorf("could not delete pod disruption budget: %v", err)
+	}
+
+	if err := c.deleteConnectionPooler(); err != nil {
+		return fmt.Errorf("could not delete connection pooler: %v", err)
+	}
+
+	if err := c.deleteLogicalReplication(); err != nil {
+		return fmt.Errorf("could not tear down logical replication: %v", err)
+	}
+
+	if err := c.deleteMetrics(); err != nil {
+		return fmt.Errorf("could not delete metrics resources: %v", err)
+	}
+
+	return nil
+}
+
+// syncStatefulSet creates the StatefulSet if it doesn't exist yet, otherwise hands the
+// existing/desired pair to updateStatefulSet so newSpec.UpdateStrategy governs whether the
+// update happens in place or via a controlled Patroni switchover.
+func (c *Cluster) syncStatefulSet(newSpec spec.PostgresSpec) error {
+	namespace := c.Metadata.Namespace
+	newStatefulSet := c.genStatefulSet(newSpec)
+
+	existingStatefulSet, err := c.KubeClient.StatefulSets(namespace).Get(newStatefulSet.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get statefulset: %v", err)
+		}
+		if _, err := c.KubeClient.StatefulSets(namespace).Create(newStatefulSet); err != nil {
+			return fmt.Errorf("could not create statefulset: %v", err)
+		}
+		return nil
+	}
+
+	return c.updateStatefulSet(existingStatefulSet, newStatefulSet, newSpec.UpdateStrategy)
+}
+
+func (c *Cluster) syncPodDisruptionBudget(numberOfInstances int32) error {
+	namespace := c.Metadata.Namespace
+	pdb := c.genPodDisruptionBudget(numberOfInstances)
+
+	if _, err := c.KubeClient.PodDisruptionBudgets(namespace).Get(pdb.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get pod disruption budget: %v", err)
+		}
+		if _, err := c.KubeClient.PodDisruptionBudgets(namespace).Create(pdb); err != nil {
+			return fmt.Errorf("could not create pod disruption budget: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := c.KubeClient.PodDisruptionBudgets(namespace).Update(pdb); err != nil {
+		return fmt.Errorf("could not update pod disruption budget: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) deletePodDisruptionBudget() error {
+	namespace := c.Metadata.Namespace
+	name := fmt.Sprintf("%s-pdb", c.Metadata.Name)
+
+	if err := c.KubeClient.PodDisruptionBudgets(namespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Cluster) syncConnectionPooler(newSpec spec.PostgresSpec) error {
+	if !newSpec.EnableConnectionPooler {
+		return c.deleteConnectionPooler()
+	}
+
+	namespace := c.Metadata.Namespace
+
+	deployment := c.genPgBouncerDeployment(newSpec.ConnectionPooler)
+	if _, err := c.KubeClient.Deployments(namespace).Get(deployment.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get pgbouncer deployment: %v", err)
+		}
+		if _, err := c.KubeClient.Deployments(namespace).Create(deployment); err != nil {
+			return fmt.Errorf("could not create pgbouncer deployment: %v", err)
+		}
+	} else if _, err := c.KubeClient.Deployments(namespace).Update(deployment); err != nil {
+		return fmt.Errorf("could not update pgbouncer deployment: %v", err)
+	}
+
+	service := c.genPgBouncerService()
+	if _, err := c.KubeClient.Services(namespace).Get(service.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get pgbouncer service: %v", err)
+		}
+		if _, err := c.KubeClient.Services(namespace).Create(service); err != nil {
+			return fmt.Errorf("could not create pgbouncer service: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := c.KubeClient.Services(namespace).Update(service); err != nil {
+		return fmt.Errorf("could not update pgbouncer service: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) deleteConnectionPooler() error {
+	namespace := c.Metadata.Namespace
+	poolerName := c.connectionPoolerName()
+
+	if err := c.KubeClient.Deployments(namespace).Delete(poolerName, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if err := c.KubeClient.Services(namespace).Delete(poolerName, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// syncMetrics ensures the ServiceMonitor and the metrics-queries ConfigMap exist, the latter
+// before the StatefulSet whose postgres_exporter sidecar (see genPodTemplate) mounts it, and
+// removes them once metrics are turned back off.
+func (c *Cluster) syncMetrics(newSpec spec.PostgresSpec) error {
+	if !c.metricsEnabled() {
+		return c.deleteMetrics()
+	}
+
+	namespace := c.Metadata.Namespace
+
+	configMap := c.genMetricsConfigMap(newSpec.MetricsQueries)
+	if _, err := c.KubeClient.ConfigMaps(namespace).Get(configMap.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get metrics configmap: %v", err)
+		}
+		if _, err := c.KubeClient.ConfigMaps(namespace).Create(configMap); err != nil {
+			return fmt.Errorf("could not create metrics configmap: %v", err)
+		}
+	} else if _, err := c.KubeClient.ConfigMaps(namespace).Update(configMap); err != nil {
+		return fmt.Errorf("could not update metrics configmap: %v", err)
+	}
+
+	serviceMonitor := c.genServiceMonitor()
+	if _, err := c.KubeClient.ServiceMonitors(namespace).Get(serviceMonitor.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get service monitor: %v", err)
+		}
+		if _, err := c.KubeClient.ServiceMonitors(namespace).Create(serviceMonitor); err != nil {
+			return fmt.Errorf("could not create service monitor: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := c.KubeClient.ServiceMonitors(namespace).Update(serviceMonitor); err != nil {
+		return fmt.Errorf("could not update service monitor: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) deleteMetrics() error {
+	namespace := c.Metadata.Namespace
+	name := fmt.Sprintf("%s-metrics-queries", c.Metadata.Name)
+
+	if err := c.KubeClient.ConfigMaps(namespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if err := c.KubeClient.ServiceMonitors(namespace).Delete(c.Metadata.Name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Cluster) syncBackup(backup spec.Backup) error {
+	if backup.Target == "" {
+		return c.deleteBackupCronJob()
+	}
+
+	namespace := c.Metadata.Namespace
+	cronJob := c.genBackupCronJob(backup)
+
+	if _, err := c.KubeClient.CronJobs(namespace).Get(cronJob.Name); err != nil {
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("could not get backup cronjob: %v", err)
+		}
+		if _, err := c.KubeClient.CronJobs(namespace).Create(cronJob); err != nil {
+			return fmt.Errorf("could not create backup cronjob: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := c.KubeClient.CronJobs(namespace).Update(cronJob); err != nil {
+		return fmt.Errorf("could not update backup cronjob: %v", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) deleteBackupCronJob() error {
+	namespace := c.Metadata.Namespace
+	name := fmt.Sprintf("%s-backup", c.Metadata.Name)
+
+	if err := c.KubeClient.CronJobs(namespace).Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
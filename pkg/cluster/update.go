@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/apps/v1beta1"
+
+	"github.bus.zalan.do/acid/postgres-operator/pkg/spec"
+)
+
+const (
+	patroniAPIPort      = 8008
+	patroniPollInterval = 5 * time.Second
+	patroniPollTimeout  = 5 * time.Minute
+)
+
+// updateStatefulSet reconciles a spec change (image bump, resource change, env change) onto
+// the running StatefulSet. With spec.UpdateStrategyOnDelete it defers to the default
+// StatefulSet rolling update; with spec.UpdateStrategyRollingSwitchover it performs a
+// controlled update that keeps write-downtime to the single switchover instead of taking
+// every pod, including the primary, down for a restart.
+func (c *Cluster) updateStatefulSet(oldStatefulSet, newStatefulSet *v1beta1.StatefulSet, strategy spec.UpdateStrategy) error {
+	if strategy != spec.UpdateStrategyRollingSwitchover {
+		_, err := c.KubeClient.StatefulSets(newStatefulSet.Namespace).Update(newStatefulSet)
+		return err
+	}
+
+	return c.rollingUpdateWithSwitchover(oldStatefulSet, newStatefulSet)
+}
+
+// rollingUpdateWithSwitchover replaces replicas one at a time, waiting for Patroni to report
+// each replacement healthy before moving on, then switches the primary over to a healthy
+// replica before finally recreating the old primary's pod.
+func (c *Cluster) rollingUpdateWithSwitchover(oldStatefulSet, newStatefulSet *v1beta1.StatefulSet) error {
+	pods, err := c.listClusterPods()
+	if err != nil {
+		return fmt.Errorf("could not list cluster pods: %v", err)
+	}
+
+	primary, replicas := splitPrimaryAndReplicas(pods)
+
+	if _, err := c.KubeClient.StatefulSets(newStatefulSet.Namespace).Update(newStatefulSet); err != nil {
+		return fmt.Errorf("could not update statefulset: %v", err)
+	}
+
+	for _, replica := range replicas {
+		if err := c.KubeClient.Pods(replica.Namespace).Delete(replica.Name, nil); err != nil {
+			return fmt.Errorf("could not delete replica pod %q: %v", replica.Name, err)
+		}
+
+		if err := c.waitForPodLabel(replica.Name, patroniPollTimeout); err != nil {
+			return fmt.Errorf("replacement for replica %q did not become healthy: %v", replica.Name, err)
+		}
+	}
+
+	if primary == nil {
+		return nil
+	}
+
+	newPrimary, err := c.pickSwitchoverCandidate(replicas)
+	if err != nil {
+		return fmt.Errorf("could not pick a switchover candidate: %v", err)
+	}
+
+	if err := c.triggerSwitchover(primary.Status.PodIP, primary.Name, newPrimary); err != nil {
+		return fmt.Errorf("could not trigger switchover: %v", err)
+	}
+
+	if err := c.KubeClient.Pods(primary.Namespace).Delete(primary.Name, nil); err != nil {
+		return fmt.Errorf("could not delete former primary pod %q: %v", primary.Name, err)
+	}
+
+	return nil
+}
+
+// triggerSwitchover asks Patroni on the current primary to hand leadership over to the given
+// candidate member via its REST API. Patroni's "leader" field must name the current leader
+// Patroni member (the primary pod), not the cluster scope (SCOPE, wired from
+// c.Metadata.Name in genPodTemplate) — the scope only identifies the cluster as a whole.
+func (c *Cluster) triggerSwitchover(primaryPodIP, leader, candidate string) error {
+	body, err := json.Marshal(map[string]string{"leader": leader, "candidate": candidate})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s:%d/switchover", primaryPodIP, patroniAPIPort)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("patroni switchover request failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *Cluster) pickSwitchoverCandidate(replicas []v1.Pod) (string, error) {
+	if len(replicas) == 0 {
+		return "", fmt.Errorf("no healthy replica available to switch over to")
+	}
+
+	return replicas[0].Name, nil
+}
+
+func splitPrimaryAndReplicas(pods []v1.Pod) (*v1.Pod, []v1.Pod) {
+	var primary *v1.Pod
+	var replicas []v1.Pod
+
+	for i := range pods {
+		pod := pods[i]
+		if pod.Labels["spilo-role"] == "master" {
+			primary = &pod
+			continue
+		}
+		replicas = append(replicas, pod)
+	}
+
+	return primary, replicas
+}